@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// NodeActivityMap tracks the number of in-flight blob fetches per source
+// node, analogous to syncthing's activityMap. It lets the replication
+// scheduler prefer less-busy peers instead of always hammering
+// candidates[0] or whatever node a map iteration happens to yield first.
+type NodeActivityMap struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var activity = &NodeActivityMap{counts: map[string]int{}}
+
+// Begin records the start of a fetch from node and returns the node's
+// new in-flight count.
+func (a *NodeActivityMap) Begin(node string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.counts[node]++
+	return a.counts[node]
+}
+
+// End records the end (success or failure) of a fetch from node.
+func (a *NodeActivityMap) End(node string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.counts[node]--
+	if a.counts[node] <= 0 {
+		delete(a.counts, node)
+	}
+}
+
+// Count returns the current number of in-flight fetches from node.
+func (a *NodeActivityMap) Count(node string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.counts[node]
+}
+
+// Snapshot returns a copy of the current per-node in-flight counts for
+// reporting over the status/debug HTTP endpoints.
+func (a *NodeActivityMap) Snapshot() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rv := make(map[string]int, len(a.counts))
+	for k, v := range a.counts {
+		rv[k] = v
+	}
+	return rv
+}
+
+// leastBusy returns the given node with the fewest
+// outstanding fetches. Ties are broken by the order the nodes were
+// given so callers get deterministic behavior with an empty map.
+func (a *NodeActivityMap) leastBusy(nodes NodeList) StorageNode {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	best := nodes[0]
+	bestCount := a.counts[best.name]
+	for _, n := range nodes[1:] {
+		if a.counts[n.name] < bestCount {
+			best = n
+			bestCount = a.counts[n.name]
+		}
+	}
+	return best
+}
+
+// activityHandler reports the current per-node in-flight fetch counts
+// so operators can see which peers are under the most replication load.
+func activityHandler(w http.ResponseWriter, req *http.Request) {
+	snap := activity.Snapshot()
+
+	type nodeCount struct {
+		Node  string `json:"node"`
+		Count int    `json:"count"`
+	}
+	ordered := make([]nodeCount, 0, len(snap))
+	for n, c := range snap {
+		ordered = append(ordered, nodeCount{n, c})
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].Node < ordered[j].Node
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ordered)
+}
+
+func init() {
+	http.HandleFunc("/.cbfs/activity/", activityHandler)
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestNodeActivityMapBeginEndCount(t *testing.T) {
+	a := &NodeActivityMap{counts: map[string]int{}}
+
+	if got := a.Count("nodeA"); got != 0 {
+		t.Fatalf("Count on unseen node = %v, want 0", got)
+	}
+
+	if got := a.Begin("nodeA"); got != 1 {
+		t.Errorf("Begin returned %v, want 1", got)
+	}
+	if got := a.Begin("nodeA"); got != 2 {
+		t.Errorf("Begin returned %v, want 2", got)
+	}
+	if got := a.Count("nodeA"); got != 2 {
+		t.Errorf("Count = %v, want 2", got)
+	}
+
+	a.End("nodeA")
+	if got := a.Count("nodeA"); got != 1 {
+		t.Errorf("Count after one End = %v, want 1", got)
+	}
+
+	a.End("nodeA")
+	if _, ok := a.counts["nodeA"]; ok {
+		t.Error("counts entry should be removed once it drops to 0")
+	}
+}
+
+func TestNodeActivityMapSnapshotIsCopy(t *testing.T) {
+	a := &NodeActivityMap{counts: map[string]int{}}
+	a.Begin("nodeA")
+
+	snap := a.Snapshot()
+	snap["nodeA"] = 99
+	snap["nodeB"] = 1
+
+	if got := a.Count("nodeA"); got != 1 {
+		t.Errorf("mutating the snapshot affected the map: Count(nodeA) = %v, want 1", got)
+	}
+	if _, ok := a.counts["nodeB"]; ok {
+		t.Error("mutating the snapshot added an entry to the map")
+	}
+}
+
+func TestNodeActivityMapLeastBusy(t *testing.T) {
+	a := &NodeActivityMap{counts: map[string]int{}}
+	nodes := NodeList{
+		StorageNode{name: "nodeA"},
+		StorageNode{name: "nodeB"},
+		StorageNode{name: "nodeC"},
+	}
+
+	a.Begin("nodeA")
+	a.Begin("nodeA")
+	a.Begin("nodeC")
+
+	if got := a.leastBusy(nodes); got.name != "nodeB" {
+		t.Errorf("leastBusy = %v, want nodeB", got.name)
+	}
+
+	// Ties break in favor of the first candidate given.
+	a.End("nodeC")
+	if got := a.leastBusy(nodes); got.name != "nodeB" {
+		t.Errorf("leastBusy with a tie = %v, want nodeB (first candidate)", got.name)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// fetchQueueItem is one pending fetch, ordered by priority (the fewer
+// replicas a blob currently has, the lower its priority value and the
+// sooner it's popped).
+type fetchQueueItem struct {
+	fs       fetchSpec
+	priority int
+	index    int
+}
+
+// fetchHeap implements container/heap.Interface over []*fetchQueueItem.
+type fetchHeap []*fetchQueueItem
+
+func (h fetchHeap) Len() int           { return len(h) }
+func (h fetchHeap) Less(i, j int) bool { return h[i].priority < h[j].priority }
+func (h fetchHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *fetchHeap) Push(x interface{}) {
+	item := x.(*fetchQueueItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *fetchHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// FetchQueue is a priority queue of pending blob fetches shared by
+// grabSomeData's startup/backfill scan and salvageBlob's node-death
+// driven repairs, so under-replicated blobs always jump ahead of
+// routine backfill regardless of which path enqueued them. It also
+// deduplicates: a (oid, node) pair already queued or being fetched is
+// dropped rather than queued twice.
+type FetchQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	h       fetchHeap
+	pending map[fetchSpec]bool
+}
+
+// NewFetchQueue returns an empty FetchQueue.
+func NewFetchQueue() *FetchQueue {
+	q := &FetchQueue{pending: map[fetchSpec]bool{}}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push enqueues fs at the given priority (lower = more urgent). It
+// returns false without enqueuing if fs is already queued or in flight.
+func (q *FetchQueue) Push(fs fetchSpec, priority int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending[fs] {
+		return false
+	}
+	q.pending[fs] = true
+	heap.Push(&q.h, &fetchQueueItem{fs: fs, priority: priority})
+	q.cond.Signal()
+	return true
+}
+
+// Pop blocks until the highest-priority item is available or ctx is
+// done, in which case ok is false.
+func (q *FetchQueue) Pop(ctx context.Context) (fs fetchSpec, ok bool) {
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		case <-stopWatching:
+		}
+	}()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.h) == 0 {
+		if ctx.Err() != nil {
+			return fetchSpec{}, false
+		}
+		q.cond.Wait()
+	}
+	item := heap.Pop(&q.h).(*fetchQueueItem)
+	return item.fs, true
+}
+
+// Done marks fs as no longer queued or in flight, so a later request for
+// the same (oid, node) isn't dropped as a duplicate.
+func (q *FetchQueue) Done(fs fetchSpec) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, fs)
+}
+
+var fetchQueue = NewFetchQueue()
+
+var startFetchersOnce sync.Once
+
+// ensureFetchersStarted starts the fixed pool of fetcher goroutines the
+// first time it's called; subsequent calls are no-ops. They run for the
+// lifetime of ctx, popping the highest-priority fetchQueue item.
+func ensureFetchersStarted(ctx context.Context) {
+	startFetchersOnce.Do(func() {
+		for i := 0; i < 4; i++ {
+			go dataInitFetcher(ctx)
+		}
+	})
+}
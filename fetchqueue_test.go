@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFetchQueuePriorityOrder(t *testing.T) {
+	q := NewFetchQueue()
+
+	q.Push(fetchSpec{"low", "nodeA"}, 5)
+	q.Push(fetchSpec{"high", "nodeB"}, 1)
+	q.Push(fetchSpec{"mid", "nodeC"}, 3)
+
+	ctx := context.Background()
+	want := []string{"high", "mid", "low"}
+	for _, oid := range want {
+		fs, ok := q.Pop(ctx)
+		if !ok {
+			t.Fatalf("Pop returned !ok, wanted oid %v", oid)
+		}
+		if fs.oid != oid {
+			t.Errorf("Pop returned oid %v, want %v", fs.oid, oid)
+		}
+	}
+}
+
+func TestFetchQueueDedup(t *testing.T) {
+	q := NewFetchQueue()
+
+	fs := fetchSpec{"dup", "nodeA"}
+	if !q.Push(fs, 1) {
+		t.Fatal("first Push of a new (oid, node) should succeed")
+	}
+	if q.Push(fs, 1) {
+		t.Fatal("Push of an already-queued (oid, node) should be dropped")
+	}
+
+	q.Done(fs)
+	if !q.Push(fs, 1) {
+		t.Fatal("Push should succeed again once Done clears the pair")
+	}
+}
+
+func TestFetchQueuePopBlocksUntilCanceled(t *testing.T) {
+	q := NewFetchQueue()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool, 1)
+	go func() {
+		_, ok := q.Pop(ctx)
+		done <- ok
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Pop returned before anything was queued or ctx was canceled")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Pop should report !ok once ctx is canceled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop didn't return after ctx was canceled")
+	}
+}
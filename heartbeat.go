@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/dustin/gomemcached"
 	"github.com/dustin/gomemcached/client"
 
@@ -32,32 +34,47 @@ var noFSFree = errors.New("no filesystemFree")
 type PeriodicJob struct {
 	period func() time.Duration
 	f      func() error
+	// Logger, if set, overrides the package-level logger for this job's
+	// "attempted"/"didn't run" bookkeeping in runPeriodicJob.
+	Logger *logrus.Entry
 }
 
 var periodicJobs = map[string]*PeriodicJob{
 	"checkStaleNodes": &PeriodicJob{
-		func() time.Duration {
+		period: func() time.Duration {
 			return globalConfig.StaleNodeCheckFreq
 		},
-		checkStaleNodes,
+		f: func() error {
+			return checkStaleNodes(withJob(rootCtx, "checkStaleNodes"))
+		},
 	},
 	"garbageCollectBlobs": &PeriodicJob{
-		func() time.Duration {
+		period: func() time.Duration {
 			return globalConfig.GCFreq
 		},
-		garbageCollectBlobs,
+		f: func() error {
+			return garbageCollectBlobs(withJob(rootCtx, "garbageCollectBlobs"))
+		},
 	},
 	"ensureMinReplCount": &PeriodicJob{
-		func() time.Duration {
+		period: func() time.Duration {
 			return globalConfig.UnderReplicaCheckFreq
 		},
-		ensureMinimumReplicaCount,
+		f: ensureMinimumReplicaCount,
 	},
 	"pruneExcessiveReplicas": &PeriodicJob{
-		func() time.Duration {
+		period: func() time.Duration {
 			return globalConfig.OverReplicaCheckFreq
 		},
-		pruneExcessiveReplicas,
+		f: pruneExcessiveReplicas,
+	},
+	"runTrashWorker": &PeriodicJob{
+		period: func() time.Duration {
+			return globalConfig.TrashWorkerFreq
+		},
+		f: func() error {
+			return RunTrashWorker(withJob(rootCtx, "runTrashWorker"))
+		},
 	},
 }
 
@@ -107,8 +124,9 @@ func runNamedGlobalTask(name string, t time.Duration, f func() error) bool {
 	return false
 }
 
-func heartbeat() {
-	for {
+func heartbeat(ctx context.Context) {
+	ctx = withJob(ctx, "heartbeat")
+	for ctx.Err() == nil {
 		u, err := url.Parse(*couchbaseServer)
 		c, err := net.Dial("tcp", u.Host)
 		localAddr := ""
@@ -117,13 +135,10 @@ func heartbeat() {
 			c.Close()
 		}
 
-		freeSpace, err := filesystemFree()
+		freeSpace, usedSpace, err := volume.Free()
 		if err != nil && err != noFSFree {
-			log.Printf("Error getting filesystem info: %v", err)
-		}
-
-		if maxStorage > 0 && freeSpace > maxStorage {
-			freeSpace = maxStorage
+			loggerFromContext(ctx).WithError(err).Error(
+				"error getting volume space info")
 		}
 
 		aboutMe := StorageNode{
@@ -131,51 +146,77 @@ func heartbeat() {
 			Type:     "node",
 			Time:     time.Now().UTC(),
 			BindAddr: *bindAddr,
-			Used:     spaceUsed,
+			Used:     usedSpace,
 			Free:     freeSpace,
 		}
 
 		err = couchbase.Set("/"+serverId, aboutMe)
 		if err != nil {
-			log.Printf("Failed to record a heartbeat: %v", err)
+			loggerFromContext(ctx).WithError(err).Error(
+				"failed to record a heartbeat")
+		}
+		if !sleepOrDone(ctx, globalConfig.HeartbeatFreq) {
+			return
 		}
-		time.Sleep(globalConfig.HeartbeatFreq)
 	}
 }
 
-func reconcileLoop() {
+func reconcileLoop(ctx context.Context) {
 	if globalConfig.ReconcileFreq == 0 {
 		return
 	}
-	for {
+	ctx = withJob(ctx, "reconcileLoop")
+	for ctx.Err() == nil {
 		err := reconcile()
 		if err != nil {
-			log.Printf("Error in reconciliation loop: %v", err)
+			loggerFromContext(ctx).WithError(err).Error(
+				"error in reconciliation loop")
+		}
+		grabSomeData(ctx)
+		if !sleepOrDone(ctx, globalConfig.ReconcileFreq) {
+			return
 		}
-		grabSomeData()
-		time.Sleep(globalConfig.ReconcileFreq)
 	}
 }
 
-func salvageBlob(oid, deadNode string, nl NodeList) {
+func salvageBlob(ctx context.Context, oid, deadNode string, nl NodeList) {
 	candidates := nl.candidatesFor(oid,
 		NodeList{nl.named(deadNode)})
 
 	if len(candidates) == 0 {
 		log.Printf("Couldn't find a candidate for blob!")
-	} else {
-		queueBlobAcquire(candidates[0], oid)
+		return
 	}
+
+	// Prefer the candidate with the fewest outstanding fetches rather
+	// than always picking candidates[0], so a single peer doesn't get
+	// hammered by every salvage of a dead node's blobs.
+	chosen := activity.leastBusy(candidates)
+
+	// A blob that just lost a replica is by definition urgent, so give
+	// it priority over grabSomeData's routine backfill: queue it at its
+	// current (post-loss) replica count rather than waiting for a
+	// startup scan to notice it.
+	priority, err := blobReplicaCount(oid)
+	if err != nil {
+		priority = 1
+	}
+
+	ensureFetchersStarted(ctx)
+	fetchQueue.Push(fetchSpec{oid, chosen.name}, priority)
 }
 
-func cleanupNode(node string) {
+func cleanupNode(ctx context.Context, node string) {
+	ctx = withNode(ctx, node)
+	l := loggerFromContext(ctx)
+
 	nodes, err := findAllNodes()
 	if err != nil {
-		log.Printf("Error finding node list, aborting clean: %v", err)
+		l.WithError(err).Error("error finding node list, aborting clean")
 		return
 	}
 
-	log.Printf("Cleaning up node %v", node)
+	l.Info("cleaning up node")
 	vres, err := couchbase.View("cbfs", "node_blobs",
 		map[string]interface{}{
 			"key":    `"` + node + `"`,
@@ -184,7 +225,7 @@ func cleanupNode(node string) {
 			"stale":  false,
 		})
 	if err != nil {
-		log.Printf("Error executing node_blobs view: %v", err)
+		l.WithError(err).Error("error executing node_blobs view")
 		return
 	}
 	foundRows := 0
@@ -193,24 +234,25 @@ func cleanupNode(node string) {
 		foundRows++
 
 		if numOwners < globalConfig.MinReplicas {
-			salvageBlob(r.ID[1:], node, nodes)
+			salvageBlob(ctx, r.ID[1:], node, nodes)
 		}
 	}
 	if foundRows == 0 && len(vres.Errors) == 0 {
-		log.Printf("Removing node record: %v", node)
+		l.Info("removing node record")
 		err = couchbase.Delete("/" + node)
 		if err != nil {
-			log.Printf("Error deleting %v node record: %v", node, err)
+			l.WithError(err).Error("error deleting node record")
 		}
 		err = couchbase.Delete("/" + node + "/r")
 		if err != nil {
-			log.Printf("Error deleting %v node counter: %v", node, err)
+			l.WithError(err).Error("error deleting node counter")
 		}
 	}
 }
 
-func checkStaleNodes() error {
-	log.Printf("Checking stale nodes")
+func checkStaleNodes(ctx context.Context) error {
+	l := loggerFromContext(ctx)
+	l.Info("checking stale nodes")
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -218,25 +260,33 @@ func checkStaleNodes() error {
 
 	for _, node := range nl {
 		d := time.Since(node.Time)
+		nodeLog := l.WithField("node", node.name)
 
 		if d > globalConfig.StaleNodeLimit {
 			if node.IsLocal() {
-				log.Printf("Would've cleaned up myself after %v",
-					d)
+				nodeLog.Infof("would've cleaned up myself after %v", d)
 				continue
 			}
-			log.Printf("  Node %v missed heartbeat schedule: %v",
-				node.name, d)
-			go cleanupNode(node.name)
+			nodeLog.Warnf("missed heartbeat schedule: %v", d)
+			nodeCtx, name := withNode(ctx, node.name), node.name
+			// Add synchronously, before spawning, so a Shutdown that
+			// races this goroutine's start can't see the counter at
+			// zero and return before cleanupNode is even registered.
+			shutdownWG.Add(1)
+			go func() {
+				defer shutdownWG.Done()
+				cleanupNode(nodeCtx, name)
+			}()
 		} else {
-			log.Printf("%v is ok at %v", node.name, d)
+			nodeLog.Debugf("ok at %v", d)
 		}
 	}
 	return nil
 }
 
-func garbageCollectBlobs() error {
-	log.Printf("Garbage collecting blobs without any file references")
+func garbageCollectBlobs(ctx context.Context) error {
+	l := loggerFromContext(ctx)
+	l.Info("garbage collecting blobs without any file references")
 
 	viewRes := struct {
 		Rows []struct {
@@ -272,6 +322,10 @@ func garbageCollectBlobs() error {
 	lastBlob := ""
 	count := 0
 	for _, r := range viewRes.Rows {
+		if ctx.Err() != nil {
+			break
+		}
+
 		blobId := r.Key[0]
 		typeFlag := r.Key[1]
 		blobNode := r.Key[2]
@@ -281,26 +335,30 @@ func garbageCollectBlobs() error {
 			lastBlob = blobId
 		case "blob":
 			if blobId != lastBlob {
+				blobLog := loggerFromContext(withOid(ctx, blobId))
 				n, ok := nm[blobNode]
 				if ok {
-					queueBlobRemoval(n, blobId)
+					if err := queueBlobTrash(n, blobId); err != nil {
+						blobLog.WithError(err).Warn(
+							"failed to queue blob for trash")
+						continue
+					}
 					count++
 				} else {
-					log.Printf("No nodemap entry for %v",
-						blobNode)
+					blobLog.Warnf("no nodemap entry for %v", blobNode)
 				}
 			}
 		}
 
 	}
-	log.Printf("Scheduled %d blobs for deletion", count)
+	l.WithField("count", count).Info("scheduled blobs for trash")
 	return nil
 }
 
 func removeBlobFromNode(oid string, node StorageNode) {
 	if node.name == serverId {
 		//local delete
-		err := removeObject(oid)
+		err := volume.Delete(oid)
 		if err != nil {
 			log.Printf("Error removing blob, already deleted? %v", err)
 		}
@@ -312,7 +370,7 @@ func removeBlobFromNode(oid string, node StorageNode) {
 			return
 		}
 	}
-	log.Printf("Removed blob: %v from node %v", oid, node.name)
+	log.Printf("Reaped trashed blob: %v from node %v", oid, node.name)
 }
 
 type fetchSpec struct {
@@ -320,14 +378,12 @@ type fetchSpec struct {
 	node string
 }
 
-func dataInitFetchOne(h, u string) error {
-	f, err := NewHashRecord(*root, h)
+func dataInitFetchOne(ctx context.Context, h, u string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	resp, err := http.Get(u)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -339,29 +395,52 @@ func dataInitFetchOne(h, u string) error {
 			h, u, resp.Status)
 	}
 
-	h, l, err := f.Process(resp.Body)
+	h, l, err := volume.Put(h, resp.Body)
 	if err != nil {
 		return err
 	}
 	return recordBlobOwnership(h, l)
 }
 
-func dataInitFetcher(nm map[string]StorageNode, ch <-chan fetchSpec) {
-	for fs := range ch {
+// dataInitFetcher is one of the fixed pool of fetcher goroutines (see
+// ensureFetchersStarted) popping the highest-priority item off the
+// shared fetchQueue for as long as ctx is live.
+func dataInitFetcher(ctx context.Context) {
+	for {
+		fs, ok := fetchQueue.Pop(ctx)
+		if !ok {
+			return
+		}
+
+		nm, err := findNodeMap()
+		if err != nil {
+			log.Printf("Error finding node map: %v", err)
+			fetchQueue.Done(fs)
+			continue
+		}
+
 		node, found := nm[fs.node]
 		if !found {
 			log.Printf("couldn't find %v", fs.node)
+			fetchQueue.Done(fs)
 			continue
 		}
+
 		log.Printf("Fetching %v from %v", fs.oid, node.BlobURL(fs.oid))
-		err := dataInitFetchOne(fs.oid, node.BlobURL(fs.oid))
+		activity.Begin(fs.node)
+		waitForShutdown(func() {
+			err = dataInitFetchOne(ctx, fs.oid, node.BlobURL(fs.oid))
+		})
+		activity.End(fs.node)
+		fetchQueue.Done(fs)
 		if err != nil {
 			log.Printf("Error fetching %v: %v", fs.oid, err)
 		}
 	}
 }
 
-func grabSomeData() {
+func grabSomeData(ctx context.Context) {
+	l := loggerFromContext(ctx)
 	viewRes := struct {
 		Rows []struct {
 			Id  string
@@ -386,13 +465,13 @@ func grabSomeData() {
 		&viewRes)
 
 	if err != nil {
-		log.Printf("Error finding docs to suck: %v", err)
+		l.WithError(err).Error("error finding docs to suck")
 		return
 	}
 
 	nl, err := findRemoteNodes()
 	if err != nil {
-		log.Printf("Error finding nodes: %v", err)
+		l.WithError(err).Error("error finding nodes")
 		return
 	}
 	nm := map[string]StorageNode{}
@@ -401,39 +480,63 @@ func grabSomeData() {
 		nm[n.name] = n
 	}
 
-	ch := make(chan fetchSpec, 1000)
-	defer close(ch)
-
-	for i := 0; i < 4; i++ {
-		go dataInitFetcher(nm, ch)
-	}
+	ensureFetchersStarted(ctx)
 
 	for _, r := range viewRes.Rows {
-		if _, ok := r.Doc.Json.Nodes[serverId]; !ok {
-			for n := range r.Doc.Json.Nodes {
-				if n != serverId {
-					ch <- fetchSpec{r.Id[1:], n}
-				}
+		if _, ok := r.Doc.Json.Nodes[serverId]; ok {
+			continue
+		}
+
+		var candidates NodeList
+		for n := range r.Doc.Json.Nodes {
+			if n == serverId {
+				continue
 			}
+			if node, ok := nm[n]; ok {
+				candidates = append(candidates, node)
+			}
+		}
+
+		if len(candidates) == 0 {
+			continue
 		}
+
+		// Pull from whichever holder currently has the fewest
+		// outstanding fetches rather than hitting all of them, so a
+		// freshly-joined node backfilling maxStartupObjects blobs
+		// doesn't thunder-herd a single busy peer. Priority is this
+		// blob's current replica count, so 1-replica blobs drain ahead
+		// of 2-replica ones regardless of queue order.
+		fs := fetchSpec{r.Id[1:], activity.leastBusy(candidates).name}
+		fetchQueue.Push(fs, len(r.Doc.Json.Nodes))
 	}
 }
 
-func runPeriodicJob(name string, job *PeriodicJob) {
-	time.Sleep(time.Second * time.Duration(5+rand.Intn(60)))
-	for {
+func runPeriodicJob(ctx context.Context, name string, job *PeriodicJob) {
+	baseCtx := withJob(ctx, name)
+
+	if !sleepOrDone(ctx, time.Second*time.Duration(5+rand.Intn(60))) {
+		return
+	}
+	for attempt := 1; ctx.Err() == nil; attempt++ {
+		l := job.Logger
+		if l == nil {
+			l = loggerFromContext(withAttempt(baseCtx, attempt))
+		}
 		if runNamedGlobalTask(name, job.period(), job.f) {
-			log.Printf("Attempted job %v", name)
+			l.Info("attempted job")
 		} else {
-			log.Printf("Didn't run job %v", name)
+			l.Info("didn't run job")
+		}
+		if !sleepOrDone(ctx, job.period()+time.Second) {
+			return
 		}
-		time.Sleep(job.period() + time.Second)
 	}
 }
 
-func runPeriodicJobs() {
+func runPeriodicJobs(ctx context.Context) {
 	for n, j := range periodicJobs {
-		go runPeriodicJob(n, j)
+		go runPeriodicJob(ctx, n, j)
 	}
 }
 
@@ -447,9 +550,8 @@ func updateConfig() error {
 	return nil
 }
 
-func reloadConfig() {
-	for {
-		time.Sleep(time.Minute)
+func reloadConfig(ctx context.Context) {
+	for sleepOrDone(ctx, time.Minute) {
 		if err := updateConfig(); err != nil {
 			log.Printf("Error updating config: %v", err)
 		}
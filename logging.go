@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// logger is the package-level structured logger. Operators can point it
+// at a JSON formatter/aggregator via SetLogger instead of relying on the
+// unstructured output of the stdlib log package.
+var logger = logrus.StandardLogger()
+
+// SetLogger replaces the package-level logger, e.g. to enable JSON
+// output for a log aggregator.
+func SetLogger(l *logrus.Logger) {
+	logger = l
+}
+
+type logCtxKey struct{}
+
+// loggerFromContext returns the *logrus.Entry accumulated on ctx, or a
+// bare entry off the package logger if none has been attached yet.
+func loggerFromContext(ctx context.Context) *logrus.Entry {
+	if e, ok := ctx.Value(logCtxKey{}).(*logrus.Entry); ok {
+		return e
+	}
+	return logrus.NewEntry(logger)
+}
+
+// withLogField returns a context carrying an updated logger entry with
+// the given field added, so downstream log calls automatically include
+// job/node/oid/attempt context without having to thread them separately.
+func withLogField(ctx context.Context, key string, value interface{}) context.Context {
+	e := loggerFromContext(ctx).WithField(key, value)
+	return context.WithValue(ctx, logCtxKey{}, e)
+}
+
+func withJob(ctx context.Context, job string) context.Context {
+	return withLogField(ctx, "job", job)
+}
+
+func withNode(ctx context.Context, node string) context.Context {
+	return withLogField(ctx, "node", node)
+}
+
+func withOid(ctx context.Context, oid string) context.Context {
+	return withLogField(ctx, "oid", oid)
+}
+
+func withAttempt(ctx context.Context, attempt int) context.Context {
+	return withLogField(ctx, "attempt", attempt)
+}
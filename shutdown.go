@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rootCtx is canceled by Shutdown to tell every periodic job and fetcher
+// goroutine to stop looping. It replaces the old run-forever-until-killed
+// behavior so cbfs can shut down cleanly under systemd/k8s SIGTERM.
+var rootCtx, rootCancel = context.WithCancel(context.Background())
+
+// shutdownWG tracks in-flight operations that should be allowed to
+// finish (or fail) before the process exits: blob fetches, node
+// cleanups, and blob removals.
+var shutdownWG sync.WaitGroup
+
+// Shutdown cancels rootCtx, waits for in-flight operations to finish (or
+// for ctx's deadline to pass, whichever is first), and only then releases
+// any global task locks held in Couchbase. A periodic job's own body
+// isn't tracked by shutdownWG (only the inner fetch/cleanup/removal calls
+// it kicks off are), so releasing the locks any earlier could let another
+// node start the same job while this node's run is still in flight. If
+// ctx is done first, Shutdown returns ctx.Err() without releasing the
+// locks; they then expire with their TTL.
+func Shutdown(ctx context.Context) error {
+	rootCancel()
+
+	done := make(chan struct{})
+	go func() {
+		shutdownWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		releaseGlobalTaskLocks()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseGlobalTaskLocks deletes this node's "/@<job>" markers so a
+// periodic job this node currently owns doesn't block on another node
+// until the marker's TTL expires. The marker is cluster-global (whichever
+// node's runNamedGlobalTask call wins the mc.Add owns it), so we only
+// ever delete one we actually hold -- otherwise a routine restart of
+// this node could rip the lock out from under another node's
+// in-progress run and let a second node start the same job concurrently.
+func releaseGlobalTaskLocks() {
+	l := loggerFromContext(rootCtx)
+	for name := range periodicJobs {
+		key := "/@" + name
+
+		var jm JobMarker
+		if err := couchbase.Get(key, &jm); err != nil {
+			// No marker, or we couldn't read it -- nothing of ours to
+			// release.
+			continue
+		}
+		if jm.Node != serverId {
+			continue
+		}
+
+		if err := couchbase.Delete(key); err != nil {
+			l.WithField("job", name).WithError(err).Warn(
+				"failed to release global task lock")
+		}
+	}
+}
+
+// waitForShutdown runs f, tracking it in shutdownWG so Shutdown can wait
+// for it to complete before the process exits.
+func waitForShutdown(f func()) {
+	shutdownWG.Add(1)
+	defer shutdownWG.Done()
+	f()
+}
+
+// sleepOrDone waits for d to elapse or ctx to be canceled, whichever
+// comes first. It returns false if ctx was canceled first, meaning the
+// caller's loop should exit.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var blobTrashLifetime = flag.Duration("blobTrashLifetime", 24*time.Hour,
+	"How long a trashed blob's marker is kept before RunTrashWorker "+
+		"removes it for real.")
+
+// TrashMarker records that oid has been scheduled for removal from node,
+// but hasn't actually been deleted yet. It protects against a bad view
+// result or a race in the file_blobs view permanently destroying the
+// only replica of a live file: the blob just sits in the trash until
+// EmptyAfter, recoverable via the untrash endpoint until then.
+type TrashMarker struct {
+	OID        string    `json:"oid"`
+	Node       string    `json:"node"`
+	Type       string    `json:"type"`
+	EmptyAfter time.Time `json:"emptyAfter"`
+}
+
+func trashKey(oid, node string) string {
+	return "/@trash/" + oid + "/" + node
+}
+
+// queueBlobTrash replaces an immediate removeBlobFromNode call with
+// writing a trash marker, so the blob is only actually removed once
+// RunTrashWorker decides it's safe.
+func queueBlobTrash(n StorageNode, oid string) error {
+	tm := TrashMarker{
+		OID:        oid,
+		Node:       n.name,
+		Type:       "trash",
+		EmptyAfter: time.Now().UTC().Add(*blobTrashLifetime),
+	}
+	return couchbase.Set(trashKey(oid, n.name), &tm)
+}
+
+// blobReplicaCount returns how many nodes currently claim to hold oid.
+func blobReplicaCount(oid string) (int, error) {
+	var doc struct {
+		Nodes map[string]string `json:"nodes"`
+	}
+	err := couchbase.Get("/"+oid, &doc)
+	if err != nil {
+		return 0, err
+	}
+	return len(doc.Nodes), nil
+}
+
+// RunTrashWorker reaps trash markers whose grace period has expired,
+// actually removing the blob from its node as long as doing so won't
+// drop a file below MinReplicas. Markers for blobs that are still
+// under-replicated are left in place to be retried on the next run.
+func RunTrashWorker(ctx context.Context) error {
+	l := loggerFromContext(ctx)
+	l.Info("looking for trashed blobs to reap")
+
+	viewRes := struct {
+		Rows []struct {
+			Key   float64
+			Value TrashMarker
+		}
+	}{}
+
+	err := couchbase.ViewCustom("cbfs", "trash",
+		map[string]interface{}{
+			"stale":  false,
+			"endkey": time.Now().UTC().Unix(),
+		}, &viewRes)
+	if err != nil {
+		return err
+	}
+
+	nm, err := findNodeMap()
+	if err != nil {
+		return err
+	}
+
+	reaped := 0
+	for _, r := range viewRes.Rows {
+		tm := r.Value
+		blobLog := loggerFromContext(withOid(ctx, tm.OID)).WithField("node", tm.Node)
+
+		count, err := blobReplicaCount(tm.OID)
+		if err != nil {
+			blobLog.WithError(err).Warn(
+				"couldn't check replica count, leaving trashed")
+			continue
+		}
+		// count still includes tm.Node itself (ownership isn't dropped
+		// until the reap below), so compare the post-reap count against
+		// MinReplicas or we'll let the last guaranteed replica go.
+		if count-1 < globalConfig.MinReplicas {
+			blobLog.Warn("replica count unhealthy, not reaping trash yet")
+			continue
+		}
+
+		n, ok := nm[tm.Node]
+		if !ok {
+			blobLog.Warn("no nodemap entry for trashed blob's node")
+			continue
+		}
+
+		waitForShutdown(func() { queueBlobRemoval(n, tm.OID) })
+		if err := couchbase.Delete(trashKey(tm.OID, tm.Node)); err != nil {
+			blobLog.WithError(err).Warn("failed to clear trash marker")
+		}
+		reaped++
+	}
+	l.WithField("count", reaped).Info("reaped trashed blobs")
+	return nil
+}
+
+// untrashHandler clears a blob's trash marker(s), resurrecting it as
+// long as RunTrashWorker hasn't already reaped it.
+func untrashHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	oid := strings.TrimPrefix(req.URL.Path, "/.cbfs/untrash/")
+	if oid == "" {
+		http.Error(w, "missing oid", http.StatusBadRequest)
+		return
+	}
+
+	nm, err := findNodeMap()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	untrashed := 0
+	for node := range nm {
+		key := trashKey(oid, node)
+		var tm TrashMarker
+		if err := couchbase.Get(key, &tm); err != nil {
+			continue
+		}
+		if err := couchbase.Delete(key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		untrashed++
+	}
+
+	if untrashed == 0 {
+		http.Error(w, "no trash marker found for oid", http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintf(w, "untrashed %d marker(s) for %v\n", untrashed, oid)
+}
+
+func init() {
+	http.HandleFunc("/.cbfs/untrash/", untrashHandler)
+}
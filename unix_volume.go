@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// UnixVolume is the original on-disk blob store: NewHashRecord for
+// writes, removeObject for deletes, filesystemFree for space
+// accounting, all rooted at a directory.
+type UnixVolume struct {
+	root string
+}
+
+// NewUnixVolume returns a Volume backed by the local filesystem at root.
+func NewUnixVolume(root string) *UnixVolume {
+	os.MkdirAll(filepath.Join(root, ".trash"), 0755)
+	return &UnixVolume{root: root}
+}
+
+func (v *UnixVolume) Get(oid string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(v.root, oid))
+}
+
+func (v *UnixVolume) Put(oid string, r io.Reader) (string, int64, error) {
+	f, err := NewHashRecord(v.root, oid)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return f.Process(r)
+}
+
+func (v *UnixVolume) Delete(oid string) error {
+	return removeObject(oid)
+}
+
+// Trash moves oid into a .trash subdirectory of root instead of
+// deleting it.
+func (v *UnixVolume) Trash(oid string) error {
+	return os.Rename(filepath.Join(v.root, oid),
+		filepath.Join(v.root, ".trash", oid))
+}
+
+func (v *UnixVolume) List() ([]string, error) {
+	var oids []string
+	entries, err := ioutil.ReadDir(v.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		oids = append(oids, e.Name())
+	}
+	return oids, nil
+}
+
+func (v *UnixVolume) Stat(oid string) (int64, error) {
+	fi, err := os.Stat(filepath.Join(v.root, oid))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (v *UnixVolume) Free() (int64, int64, error) {
+	free, err := filesystemFree()
+	if err != nil && err != noFSFree {
+		return 0, 0, err
+	}
+	if maxStorage > 0 && free > maxStorage {
+		free = maxStorage
+	}
+	return free, spaceUsed, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+var volumeType = flag.String("volume", "unix",
+	"Storage backend for this node: \"unix\" (local disk) or \"s3\".")
+
+// Volume abstracts the blob storage backend so a node can be backed by
+// local disk, S3, or anything else that can satisfy this interface. The
+// "unix" volume (UnixVolume) wraps the original NewHashRecord/
+// removeObject/filesystemFree disk code; "s3" (S3Volume) stores blobs
+// as objects in a bucket for cheap cold replicas.
+type Volume interface {
+	// Get opens the blob named oid for reading.
+	Get(oid string) (io.ReadCloser, error)
+	// Put streams r into the volume, returning the hash computed over
+	// the data and the number of bytes written.
+	Put(oid string, r io.Reader) (hash string, length int64, err error)
+	// Delete immediately and permanently removes oid.
+	Delete(oid string) error
+	// Trash removes oid in whatever way this backend considers safest,
+	// e.g. moving it aside for recovery rather than deleting outright.
+	Trash(oid string) error
+	// List returns the oids currently stored in the volume.
+	List() ([]string, error)
+	// Stat reports the size in bytes of oid.
+	Stat(oid string) (int64, error)
+	// Free reports free and used space in bytes. Backends without a
+	// meaningful notion of free space (e.g. S3) report a configured
+	// cap, or math.MaxInt64 if none was given.
+	Free() (free, used int64, err error)
+}
+
+// volume is the active backend for this node, set up by initVolume
+// after flags have been parsed.
+var volume Volume
+
+// initVolume sets up the package-level volume from -volume. It must be
+// called after flag.Parse().
+func initVolume() error {
+	switch *volumeType {
+	case "", "unix":
+		volume = NewUnixVolume(*root)
+	case "s3":
+		if *s3Bucket == "" {
+			return fmt.Errorf("-volume=s3 requires -s3Bucket")
+		}
+		volume = NewS3Volume(*s3Bucket)
+	default:
+		return fmt.Errorf("unknown volume type %q", *volumeType)
+	}
+	return nil
+}